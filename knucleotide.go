@@ -12,10 +12,15 @@ package main
 import (
 	"bufio"
 	"bytes"
+	"flag"
 	"fmt"
+	"io"
 	"os"
 	"runtime"
 	"sort"
+	"strconv"
+	"strings"
+	"sync"
 )
 
 // seqString is a sequence of nucleotides as a string: "ACGT..."
@@ -76,6 +81,38 @@ func (num seq32) seqString(length int) seqString {
 	return seqString(sequence)
 }
 
+// reverseComplement returns the reverse complement of a length-base-long
+// k-mer: A<->T and C<->G (XOR 2 under this encoding), bases in reverse order.
+func (num seq32) reverseComplement(length int) seq32 {
+	var rc seq32
+	for i := 0; i < length; i++ {
+		rc = rc<<2 | (num & 3) ^ 2
+		num = num >> 2
+	}
+	return rc
+}
+
+// seqString converts a seq64 to a human readable string
+func (num seq64) seqString(length int) seqString {
+	sequence := make(seqChars, length)
+	for i := 0; i < length; i++ {
+		sequence[length-i-1] = "ACTG"[num&3]
+		num = num >> 2
+	}
+	return seqString(sequence)
+}
+
+// reverseComplement returns the reverse complement of a length-base-long
+// k-mer: A<->T and C<->G (XOR 2 under this encoding), bases in reverse order.
+func (num seq64) reverseComplement(length int) seq64 {
+	var rc seq64
+	for i := 0; i < length; i++ {
+		rc = rc<<2 | (num & 3) ^ 2
+		num = num >> 2
+	}
+	return rc
+}
+
 type counter uint32
 
 type seqCount struct {
@@ -89,28 +126,114 @@ type seqCounter interface {
 	sortedCounts(length int) []seqCount
 }
 
-func (dna seqBits) countSequences(length int) seqCounter {
+// countSequences counts k-mers of the given length. When canonical is true,
+// each k-mer is merged with its reverse complement under the
+// lexicographically smaller of the two 2-bit encodings, so e.g. "GGT" and its
+// reverse complement "ACC" are counted together.
+func (dna seqBits) countSequences(length int, canonical bool) seqCounter {
+	if canonical {
+		if length <= 16 {
+			return dna._count32(length, canonical)
+		}
+		return dna._count64(length, canonical)
+	}
+	switch {
+	case length <= 8:
+		return dna._countArr(length)
+	case length <= 16:
+		return dna._count32(length, canonical)
+	default:
+		return dna._count64(length, canonical)
+	}
+}
+
+// countSequencesParallel splits dna into shards contiguous shards (overlapping
+// by length-1 bytes so no k-mer straddles a shard boundary), counts each shard
+// on its own goroutine, then merges the per-shard results. Long jobs (e.g.
+// length 18) can use this to soak up worker goroutines that would otherwise
+// sit idle while shorter jobs finish.
+func (dna seqBits) countSequencesParallel(length, shards int) seqCounter {
+	if shards <= 1 || len(dna) < shards*length {
+		return dna.countSequences(length, false)
+	}
 	if length <= 16 {
-		return dna._count32(length)
-	} else {
-		return dna._count64(length)
+		return dna._count32Parallel(length, shards)
+	}
+	return dna._count64Parallel(length, shards)
+}
+
+// shardRanges splits [0, total) into shards contiguous, overlapping ranges
+// each long enough that every window of the given length lies fully within
+// at least one shard.
+func shardRanges(total, length, shards int) [][2]int {
+	step := total / shards
+	overlap := length - 1
+	ranges := make([][2]int, shards)
+	for i := 0; i < shards; i++ {
+		start := i * step
+		end := start + step + overlap
+		if i == shards-1 || end > total {
+			end = total
+		}
+		ranges[i] = [2]int{start, end}
 	}
+	return ranges
+}
+
+// seqCountsArr is a dense, directly-indexed counter array for short k-mers
+// (length <= 8, i.e. at most 65 536 buckets). Indexing by the seq32 key
+// avoids map hashing entirely and keeps the hot loop cache-friendly.
+type seqCountsArr []counter
+
+var _ seqCounter = seqCountsArr{}
+
+func (dna seqBits) _countArr(length int) seqCountsArr {
+	counts := make(seqCountsArr, 1<<uint(2*length))
+	key := dna[0 : length-1].seq32()
+	mask := seq32(1)<<uint(2*length) - 1
+	for index := length - 1; index < len(dna); index++ {
+		key = key<<2&mask | seq32(dna[index])
+		counts[key]++
+	}
+	return counts
+}
+
+func (counts seqCountsArr) countOf(seq seqString) counter {
+	return counts[seq.seqBits().seq32()]
+}
+
+func (counts seqCountsArr) sortedCounts(length int) []seqCount {
+	list := make([]seqCount, 0, len(counts))
+	for key, n := range counts {
+		if n == 0 {
+			continue
+		}
+		list = append(list, seqCount{seq32(key).seqString(length), n})
+	}
+	sort.Sort(seqCountsDesc(list))
+	return list
 }
 
 type seqCounts32 map[seq32]*counter
 
 var _ seqCounter = seqCounts32{}
 
-func (dna seqBits) _count32(length int) seqCounts32 {
+func (dna seqBits) _count32(length int, canonical bool) seqCounts32 {
 	counts := make(seqCounts32)
 	key := dna[0 : length-1].seq32()
 	mask := seq32(1)<<uint(2*length) - 1
 	for index := length - 1; index < len(dna); index++ {
 		key = key<<2&mask | seq32(dna[index])
-		pointer := counts[key]
+		k := key
+		if canonical {
+			if rc := key.reverseComplement(length); rc < k {
+				k = rc
+			}
+		}
+		pointer := counts[k]
 		if pointer == nil {
 			n := counter(1)
-			counts[key] = &n
+			counts[k] = &n
 		} else {
 			*pointer++
 		}
@@ -118,18 +241,65 @@ func (dna seqBits) _count32(length int) seqCounts32 {
 	return counts
 }
 
+// _count32Local counts k-mers in a single shard, storing counts directly in
+// the map (not behind a pointer) so the hot inner loop does no allocation.
+func (dna seqBits) _count32Local(length int) map[seq32]counter {
+	counts := make(map[seq32]counter)
+	key := dna[0 : length-1].seq32()
+	mask := seq32(1)<<uint(2*length) - 1
+	for index := length - 1; index < len(dna); index++ {
+		key = key<<2&mask | seq32(dna[index])
+		counts[key]++
+	}
+	return counts
+}
+
+func (dna seqBits) _count32Parallel(length, shards int) seqCounts32 {
+	ranges := shardRanges(len(dna), length, shards)
+	local := make([]map[seq32]counter, shards)
+	var wg sync.WaitGroup
+	wg.Add(shards)
+	for i, r := range ranges {
+		go func(i int, shard seqBits) {
+			defer wg.Done()
+			local[i] = shard._count32Local(length)
+		}(i, dna[r[0]:r[1]])
+	}
+	wg.Wait()
+
+	merged := make(seqCounts32)
+	for _, m := range local {
+		for key, n := range m {
+			pointer := merged[key]
+			if pointer == nil {
+				c := n
+				merged[key] = &c
+			} else {
+				*pointer += n
+			}
+		}
+	}
+	return merged
+}
+
 type seqCounts64 map[seq64]*counter
 
-func (dna seqBits) _count64(length int) seqCounts64 {
+func (dna seqBits) _count64(length int, canonical bool) seqCounts64 {
 	counts := make(seqCounts64)
 	key := dna[0 : length-1].seq64()
 	mask := seq64(1)<<uint(2*length) - 1
 	for index := length - 1; index < len(dna); index++ {
 		key = key<<2&mask | seq64(dna[index])
-		pointer := counts[key]
+		k := key
+		if canonical {
+			if rc := key.reverseComplement(length); rc < k {
+				k = rc
+			}
+		}
+		pointer := counts[k]
 		if pointer == nil {
 			n := counter(1)
-			counts[key] = &n
+			counts[k] = &n
 		} else {
 			*pointer++
 		}
@@ -137,6 +307,47 @@ func (dna seqBits) _count64(length int) seqCounts64 {
 	return counts
 }
 
+// _count64Local counts k-mers in a single shard, storing counts directly in
+// the map (not behind a pointer) so the hot inner loop does no allocation.
+func (dna seqBits) _count64Local(length int) map[seq64]counter {
+	counts := make(map[seq64]counter)
+	key := dna[0 : length-1].seq64()
+	mask := seq64(1)<<uint(2*length) - 1
+	for index := length - 1; index < len(dna); index++ {
+		key = key<<2&mask | seq64(dna[index])
+		counts[key]++
+	}
+	return counts
+}
+
+func (dna seqBits) _count64Parallel(length, shards int) seqCounts64 {
+	ranges := shardRanges(len(dna), length, shards)
+	local := make([]map[seq64]counter, shards)
+	var wg sync.WaitGroup
+	wg.Add(shards)
+	for i, r := range ranges {
+		go func(i int, shard seqBits) {
+			defer wg.Done()
+			local[i] = shard._count64Local(length)
+		}(i, dna[r[0]:r[1]])
+	}
+	wg.Wait()
+
+	merged := make(seqCounts64)
+	for _, m := range local {
+		for key, n := range m {
+			pointer := merged[key]
+			if pointer == nil {
+				c := n
+				merged[key] = &c
+			} else {
+				*pointer += n
+			}
+		}
+	}
+	return merged
+}
+
 func (counts seqCounts32) countOf(seq seqString) counter {
 	p := counts[seq.seqBits().seq32()]
 	if p == nil {
@@ -145,6 +356,14 @@ func (counts seqCounts32) countOf(seq seqString) counter {
 	return *p
 }
 
+func (counts seqCounts64) allCounts(length int) []seqCount {
+	list := make([]seqCount, 0, len(counts))
+	for key, counter := range counts {
+		list = append(list, seqCount{key.seqString(length), *counter})
+	}
+	return list
+}
+
 func (counts seqCounts64) countOf(seq seqString) counter {
 	p := counts[seq.seqBits().seq64()]
 	if p == nil {
@@ -183,7 +402,9 @@ func (counts seqCounts32) sortedCounts(length int) []seqCount {
 }
 
 func (counts seqCounts64) sortedCounts(length int) []seqCount {
-	panic("not implemented")
+	seqCounts := counts.allCounts(length)
+	sort.Sort(seqCountsDesc(seqCounts))
+	return seqCounts
 }
 
 type job struct {
@@ -201,9 +422,18 @@ func makeJob(j func(dna seqBits) string) job {
 	}
 }
 
-func frequencyReportJob(length int) job {
+func frequencyReportJob(length int, canonical bool) job {
+	return makeJob(func(dna seqBits) string {
+		return frequencyReport(dna, length, canonical)
+	})
+}
+
+// frequencyReportJobParallel is like frequencyReportJob but shards the
+// counting across shards goroutines, for long-k jobs that would otherwise
+// leave the worker pool idle while they run alone.
+func frequencyReportJobParallel(length, shards int) job {
 	return makeJob(func(dna seqBits) string {
-		return frequencyReport(dna, length)
+		return frequencyReportParallel(dna, length, shards)
 	})
 }
 
@@ -213,9 +443,13 @@ func sequenceReportJob(sequence seqString) job {
 	})
 }
 
-var jobs = [...]job{
-	frequencyReportJob(1),
-	frequencyReportJob(2),
+// defaultJobs is the job set run when no -freq or -count flags are given.
+var defaultJobs = []job{
+	frequencyReportJob(1, false),
+	frequencyReportJob(2, false),
+	frequencyReportJob(12, true),
+	frequencyReportJobParallel(18, runtime.NumCPU()),
+	frequencyReportJobParallel(24, runtime.NumCPU()),
 	sequenceReportJob("GGT"),
 	sequenceReportJob("GGTA"),
 	sequenceReportJob("GGTATT"),
@@ -223,8 +457,85 @@ var jobs = [...]job{
 	sequenceReportJob("GGTATTTTAATTTATAGT"),
 }
 
+// intListFlag accumulates repeated -freq k values.
+type intListFlag []int
+
+func (l *intListFlag) String() string { return fmt.Sprint([]int(*l)) }
+
+func (l *intListFlag) Set(value string) error {
+	k, err := strconv.Atoi(value)
+	if err != nil {
+		return fmt.Errorf("-freq %s: %v", value, err)
+	}
+	if k <= 0 || k > 32 {
+		return fmt.Errorf("-freq %s: k must be between 1 and 32", value)
+	}
+	*l = append(*l, k)
+	return nil
+}
+
+// seqListFlag accumulates repeated -count SEQ values.
+type seqListFlag []seqString
+
+func (l *seqListFlag) String() string { return fmt.Sprint([]seqString(*l)) }
+
+func (l *seqListFlag) Set(value string) error {
+	seq := seqString(strings.ToUpper(value))
+	if err := validateSequence(seq); err != nil {
+		return err
+	}
+	*l = append(*l, seq)
+	return nil
+}
+
+func validateSequence(seq seqString) error {
+	if len(seq) == 0 {
+		return fmt.Errorf("-count: sequence must not be empty")
+	}
+	if len(seq) > 32 {
+		return fmt.Errorf("-count %s: sequence too long (max 32 bases, got %d)", seq, len(seq))
+	}
+	for _, base := range []byte(seq) {
+		switch base {
+		case 'A', 'C', 'G', 'T':
+		default:
+			return fmt.Errorf("-count %s: invalid base %q, only ACGT allowed", seq, base)
+		}
+	}
+	return nil
+}
+
 func main() {
-	dna := readSequence(">THREE").toBits()
+	var freqLengths intListFlag
+	var countSeqs seqListFlag
+	record := flag.String("record", ">THREE", "FASTA record prefix to load")
+	input := flag.String("input", "", "input FASTA file (default: stdin)")
+	flag.Var(&freqLengths, "freq", "queue a frequency report job for k-mer length `k` (repeatable)")
+	flag.Var(&countSeqs, "count", "queue a sequence count job for `SEQ` (ACGT only, repeatable)")
+	flag.Parse()
+
+	jobs := defaultJobs
+	if len(freqLengths) > 0 || len(countSeqs) > 0 {
+		jobs = make([]job, 0, len(freqLengths)+len(countSeqs))
+		for _, k := range freqLengths {
+			jobs = append(jobs, frequencyReportJob(k, false))
+		}
+		for _, seq := range countSeqs {
+			jobs = append(jobs, sequenceReportJob(seq))
+		}
+	}
+
+	in := os.Stdin
+	if *input != "" {
+		f, err := os.Open(*input)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		in = f
+	}
+	dna := readSequence(in, *record).toBits()
 
 	queue := make(chan func(), len(jobs))
 	for i := runtime.NumCPU(); i > 0; i-- {
@@ -250,14 +561,18 @@ func main() {
 	close(queue)
 }
 
-func readSequence(prefix string) (data seqChars) {
+func readSequence(r io.Reader, prefix string) (data seqChars) {
 	// Find the sequence
 	pfx := []byte(prefix)
 	var lineCount int
-	in := bufio.NewReaderSize(os.Stdin, 1<<20)
+	in := bufio.NewReaderSize(r, 1<<20)
 	for {
 		line, err := in.ReadSlice('\n')
 		if err != nil {
+			if err == io.EOF {
+				fmt.Fprintf(os.Stderr, "record %q not found in input\n", prefix)
+				os.Exit(1)
+			}
 			panic("read error")
 		}
 		lineCount++
@@ -286,8 +601,24 @@ func readSequence(prefix string) (data seqChars) {
 	return
 }
 
-func frequencyReport(dna seqBits, length int) string {
-	counts := dna.countSequences(length)
+func frequencyReport(dna seqBits, length int, canonical bool) string {
+	report := formatFrequencyReport(dna, length, dna.countSequences(length, canonical))
+	if canonical {
+		return fmt.Sprintf("# canonical k=%d\n%s", length, report)
+	}
+	return report
+}
+
+func sequenceReport(dna seqBits, sequence seqString) string {
+	counts := dna.countSequences(len(sequence), false)
+	return fmt.Sprintf("%v\t%v", counts.countOf(sequence), sequence)
+}
+
+func frequencyReportParallel(dna seqBits, length, shards int) string {
+	return formatFrequencyReport(dna, length, dna.countSequencesParallel(length, shards))
+}
+
+func formatFrequencyReport(dna seqBits, length int, counts seqCounter) string {
 	sequences := counts.sortedCounts(length)
 
 	var buf bytes.Buffer
@@ -301,8 +632,3 @@ func frequencyReport(dna seqBits, length int) string {
 	}
 	return buf.String()
 }
-
-func sequenceReport(dna seqBits, sequence seqString) string {
-	counts := dna.countSequences(len(sequence))
-	return fmt.Sprintf("%v\t%v", counts.countOf(sequence), sequence)
-}